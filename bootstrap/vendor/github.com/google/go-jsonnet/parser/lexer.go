@@ -0,0 +1,935 @@
+/*
+Copyright 2016 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// tokenKind discriminates the type of a lexical token.
+type tokenKind int
+
+const (
+	tokenBraceL tokenKind = iota
+	tokenBraceR
+	tokenBracketL
+	tokenBracketR
+	tokenComma
+	tokenDollar
+	tokenDot
+	tokenParenL
+	tokenParenR
+	tokenSemicolon
+
+	tokenIdentifier
+	tokenNumber
+	tokenOperator
+	tokenStringDouble
+	tokenStringSingle
+	tokenStringBlock
+	tokenVerbatimStringDouble
+	tokenVerbatimStringSingle
+
+	// The three pieces of a string containing one or more ${...}
+	// interpolations, e.g. "a${ x }b${ y }c" lexes as:
+	//   tokenStringInterpStart("a") x tokenStringInterpMid("b") y tokenStringInterpEnd("c")
+	tokenStringInterpStart
+	tokenStringInterpMid
+	tokenStringInterpEnd
+
+	// Keywords
+	tokenAssert
+	tokenElse
+	tokenError
+	tokenFalse
+	tokenFor
+	tokenFunction
+	tokenIf
+	tokenImport
+	tokenImportStr
+	tokenIn
+	tokenLocal
+	tokenNullLit
+	tokenSelf
+	tokenSuper
+	tokenTailStrict
+	tokenThen
+	tokenTrue
+
+	tokenEndOfFile
+)
+
+var tokenKindStrings = [...]string{
+	tokenBraceL:    "\"{\"",
+	tokenBraceR:    "\"}\"",
+	tokenBracketL:  "\"[\"",
+	tokenBracketR:  "\"]\"",
+	tokenComma:     "\",\"",
+	tokenDollar:    "\"$\"",
+	tokenDot:       "\".\"",
+	tokenParenL:    "\"(\"",
+	tokenParenR:    "\")\"",
+	tokenSemicolon: "\";\"",
+
+	tokenIdentifier:           "IDENTIFIER",
+	tokenNumber:               "NUMBER",
+	tokenOperator:             "OPERATOR",
+	tokenStringDouble:         "STRING",
+	tokenStringSingle:         "STRING",
+	tokenStringBlock:          "STRING_BLOCK",
+	tokenVerbatimStringDouble: "VERBATIM_STRING",
+	tokenVerbatimStringSingle: "VERBATIM_STRING",
+	tokenStringInterpStart:    "STRING_INTERP_START",
+	tokenStringInterpMid:      "STRING_INTERP_MID",
+	tokenStringInterpEnd:      "STRING_INTERP_END",
+
+	tokenAssert:     "assert",
+	tokenElse:       "else",
+	tokenError:      "error",
+	tokenFalse:      "false",
+	tokenFor:        "for",
+	tokenFunction:   "function",
+	tokenIf:         "if",
+	tokenImport:     "import",
+	tokenImportStr:  "importstr",
+	tokenIn:         "in",
+	tokenLocal:      "local",
+	tokenNullLit:    "null",
+	tokenSelf:       "self",
+	tokenSuper:      "super",
+	tokenTailStrict: "tailstrict",
+	tokenThen:       "then",
+	tokenTrue:       "true",
+
+	tokenEndOfFile: "end of file",
+}
+
+func (k tokenKind) String() string {
+	if int(k) < 0 || int(k) >= len(tokenKindStrings) {
+		return "UNKNOWN"
+	}
+	return tokenKindStrings[k]
+}
+
+// keywords maps identifier text to its keyword token kind. Looked up with a
+// straightforward map probe; an identifier that misses is just an identifier.
+var keywords = map[string]tokenKind{
+	"assert":     tokenAssert,
+	"else":       tokenElse,
+	"error":      tokenError,
+	"false":      tokenFalse,
+	"for":        tokenFor,
+	"function":   tokenFunction,
+	"if":         tokenIf,
+	"import":     tokenImport,
+	"importstr":  tokenImportStr,
+	"in":         tokenIn,
+	"local":      tokenLocal,
+	"null":       tokenNullLit,
+	"self":       tokenSelf,
+	"super":      tokenSuper,
+	"tailstrict": tokenTailStrict,
+	"then":       tokenThen,
+	"true":       tokenTrue,
+}
+
+// Location is a single point in an input string, counted in the same way a
+// text editor would (1-based lines and columns), plus the 0-based offset
+// from the start of the input. Offset counts runes, not bytes, so it differs
+// from a byte offset once the input contains non-ASCII characters.
+type Location struct {
+	Line   int
+	Column int
+	Offset int
+}
+
+func (l Location) String() string {
+	return fmt.Sprintf("%d:%d", l.Line, l.Column)
+}
+
+// LocationRange attaches a file name to a span between two Locations.
+type LocationRange struct {
+	FileName string
+	Begin    Location
+	End      Location
+}
+
+func (lr LocationRange) String() string {
+	if lr.FileName == "" {
+		return lr.Begin.String()
+	}
+	return fmt.Sprintf("%s:%s", lr.FileName, lr.Begin)
+}
+
+// token represents a single lexical token.
+type token struct {
+	kind tokenKind
+
+	// Fodder holds the whitespace and comments consumed immediately
+	// before this token, in source order. It is exported so that tools
+	// built on top of this package (formatters, linters, doc
+	// generators) can reconstruct the original source exactly, not just
+	// its meaningful tokens.
+	Fodder []FodderElement
+
+	data string
+
+	// Only set for tokenStringBlock.
+	stringBlockIndent     string
+	stringBlockTermIndent string
+
+	// Range is exported so that tools built on top of this package (an
+	// IDE's go-to-definition, a formatter's diagnostics) can report a
+	// precise source span for the token without re-lexing the input.
+	Range LocationRange
+}
+
+func (t token) String() string {
+	if t.data != "" {
+		return fmt.Sprintf("%v %q", t.kind, t.data)
+	}
+	return t.kind.String()
+}
+
+// Tokens is a sequence of token, the output of Lex.
+type Tokens []token
+
+// FodderKind classifies a single piece of fodder: the comments and
+// whitespace that appear between meaningful tokens.
+type FodderKind int
+
+const (
+	// FodderLineComment is a "// ..." comment running to end of line.
+	FodderLineComment FodderKind = iota
+	// FodderHashComment is a "# ..." comment running to end of line.
+	FodderHashComment
+	// FodderBlockComment is a "/* ... */" comment, which may span lines.
+	FodderBlockComment
+	// FodderBlankLine is a run of whitespace containing at least one
+	// fully empty line, e.g. the gap between two paragraphs of comments.
+	FodderBlankLine
+	// FodderWhitespace is any other run of spaces, tabs and single line
+	// breaks between tokens.
+	FodderWhitespace
+)
+
+// FodderElement is one piece of fodder: a single comment or a single run
+// of whitespace, together with its raw text and source span.
+type FodderElement struct {
+	Kind FodderKind
+	Text string
+	Loc  LocationRange
+}
+
+// LexError is a lexing error tied to a single point in the source: the
+// offending character for a bad token, or the opening delimiter for an
+// unterminated one. The exception is a string left unterminated after an
+// interpolation: its error points just past the "}" that closed the last
+// interpolation, not at the string's opening quote. It replaces the lexer's previous practice of formatting
+// "name:line:col message" directly into an opaque error string, so that
+// callers who want the structured position (an IDE diagnostic, say) don't
+// have to parse it back out of Error().
+type LexError struct {
+	FileName string
+	Loc      Location
+	Msg      string
+}
+
+func (e *LexError) Error() string {
+	if e.FileName == "" {
+		return fmt.Sprintf("%s %s", e.Loc, e.Msg)
+	}
+	return fmt.Sprintf("%s:%s %s", e.FileName, e.Loc, e.Msg)
+}
+
+// locError builds a LexError pointing at loc.Begin: every lexer error
+// reports a single location, never a range, so the range's start is what
+// gets kept.
+func locError(loc LocationRange, format string, args ...interface{}) error {
+	return &LexError{FileName: loc.FileName, Loc: loc.Begin, Msg: fmt.Sprintf(format, args...)}
+}
+
+// interpFrame records one "${" we are currently past, so that the matching
+// "}" can be told apart from the braces of an ordinary object literal
+// nested inside the interpolated expression: every '{' we lex while a
+// frame is on top of the stack bumps its braceDepth, and every '}' either
+// closes a nested object (braceDepth > 0) or closes the interpolation
+// itself (braceDepth == 0), resuming string-scanning with the saved quote.
+type interpFrame struct {
+	quote      rune
+	braceDepth int
+	begin      Location // location of the opening "${", for error messages
+}
+
+// lexer turns Jsonnet source into a stream of tokens.
+type lexer struct {
+	fileName string
+	input    []rune
+
+	pos  int // index into input
+	line int
+	col  int // 1-based column, counted in runes
+
+	tokens Tokens
+	err    error
+
+	// pendingFodder accumulates comments and whitespace seen since the
+	// last token was emitted; it is attached to the next token emitted
+	// (or to the final EOF token, for trailing fodder).
+	pendingFodder []FodderElement
+
+	// interpStack tracks string interpolations we are currently inside
+	// the expression part of, innermost last. Pushed by scanStringSegment
+	// on "${", popped by lexToken on the matching "}".
+	interpStack []interpFrame
+
+	// Set only when lexing is driven through LexStream.
+	emitCh chan token
+	quit   chan struct{}
+}
+
+func newLexer(name, input string) *lexer {
+	return &lexer{
+		fileName: name,
+		input:    []rune(input),
+		pos:      0,
+		line:     1,
+		col:      1,
+	}
+}
+
+func (l *lexer) eof() bool {
+	return l.pos >= len(l.input)
+}
+
+// peekAt returns the rune `ahead` positions past the cursor, or 0 at EOF.
+func (l *lexer) peekAt(ahead int) rune {
+	if l.pos+ahead >= len(l.input) {
+		return 0
+	}
+	return l.input[l.pos+ahead]
+}
+
+func (l *lexer) peek() rune {
+	return l.peekAt(0)
+}
+
+func (l *lexer) loc() Location {
+	return Location{Line: l.line, Column: l.col, Offset: l.pos}
+}
+
+func (l *lexer) locRange(begin Location) LocationRange {
+	return LocationRange{FileName: l.fileName, Begin: begin, End: l.loc()}
+}
+
+// next consumes and returns the current rune, advancing line/col bookkeeping.
+// A bare '\r' (old Mac line endings) ends a line on its own, same as '\n'.
+// A '\r' immediately followed by '\n' is one line break, not two: the '\r'
+// is consumed as an ordinary character and it's the '\n' that advances the
+// line, so "\r\n" and "\n" count identically.
+func (l *lexer) next() rune {
+	r := l.input[l.pos]
+	l.pos++
+	switch {
+	case r == '\n':
+		l.line++
+		l.col = 1
+	case r == '\r' && l.pos < len(l.input) && l.input[l.pos] == '\n':
+		l.col++
+	case r == '\r':
+		l.line++
+		l.col = 1
+	default:
+		l.col++
+	}
+	return r
+}
+
+func isIdentifierStart(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func isIdentifierCont(r rune) bool {
+	return isIdentifierStart(r) || (r >= '0' && r <= '9')
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+const symbolChars = "!~+-&|^=<>*/%:"
+
+func isSymbol(r rune) bool {
+	return strings.ContainsRune(symbolChars, r)
+}
+
+// Lex scans Jsonnet source into a flat slice of tokens, or returns the
+// first lexing error encountered.
+func Lex(name, input string) (Tokens, error) {
+	l := newLexer(name, input)
+	l.run()
+	if l.err != nil {
+		return nil, l.err
+	}
+	return l.tokens, nil
+}
+
+// LexStream lexes input the same way Lex does, but emits each token on a
+// channel as soon as it is produced instead of materializing the whole
+// Tokens slice up front. This lets a parser run concurrently with the
+// lexer on large inputs, overlapping the two passes and avoiding the need
+// to hold every token in memory at once.
+//
+// The token channel is closed when lexing finishes, successfully or not;
+// at most one error is ever sent on the error channel, immediately before
+// the token channel closes. The caller isn't required to drain the
+// channel to EOF: calling the returned cancel func unblocks the lexing
+// goroutine's pending send so it can finish up instead of blocking
+// forever. Calling cancel after the channel is already closed is a no-op.
+func LexStream(name, input string) (<-chan token, <-chan error, func()) {
+	l := newLexer(name, input)
+	l.emitCh = make(chan token)
+	l.quit = make(chan struct{})
+	errCh := make(chan error, 1)
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			close(l.quit)
+		})
+	}
+
+	go func() {
+		defer close(l.emitCh)
+		l.run()
+		if l.err != nil {
+			errCh <- l.err
+		}
+	}()
+
+	return l.emitCh, errCh, cancel
+}
+
+// emit records a token and, when lexing in streaming mode, publishes it on
+// emitCh. The select against quit lets LexStream's goroutine exit cleanly
+// if the consumer stops draining the channel.
+func (l *lexer) emit(kind tokenKind, begin Location, data string) {
+	l.emitToken(token{kind: kind, data: data, Range: l.locRange(begin)})
+}
+
+func (l *lexer) emitToken(t token) {
+	t.Fodder, l.pendingFodder = l.pendingFodder, nil
+	if l.emitCh == nil {
+		l.tokens = append(l.tokens, t)
+		return
+	}
+	select {
+	case l.emitCh <- t:
+	case <-l.quit:
+	}
+}
+
+// stateFn is a lexer state: it consumes some input and returns the state
+// to run next, or nil once lexing has finished (successfully or not).
+type stateFn func(*lexer) stateFn
+
+// run drives the lexer to completion by repeatedly invoking the current
+// state, in the style described in Rob Pike's "Lexical Scanning in Go".
+func (l *lexer) run() {
+	for state := lexText; state != nil; {
+		state = state(l)
+	}
+}
+
+// lexText is the lexer's top-level state: it records fodder (whitespace
+// and comments) on l.pendingFodder and otherwise dispatches a single token
+// to lexToken.
+func lexText(l *lexer) stateFn {
+	for !l.eof() {
+		c := l.peek()
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			l.lexWhitespace()
+			continue
+
+		case c == '#':
+			l.lexLineComment(FodderHashComment)
+			continue
+
+		case c == '/' && l.peekAt(1) == '/':
+			l.lexLineComment(FodderLineComment)
+			continue
+
+		case c == '/' && l.peekAt(1) == '*':
+			if err := l.lexBlockComment(); err != nil {
+				l.err = err
+				return nil
+			}
+			continue
+		}
+
+		begin := l.loc()
+		if err := l.lexToken(begin, c); err != nil {
+			l.err = err
+			return nil
+		}
+		return lexText
+	}
+
+	if len(l.interpStack) > 0 {
+		top := l.interpStack[len(l.interpStack)-1]
+		l.err = locError(l.locRange(top.begin), "Unterminated string interpolation")
+		return nil
+	}
+
+	l.emitToken(token{kind: tokenEndOfFile, Range: l.locRange(l.loc())})
+	return nil
+}
+
+// addFodder records one piece of fodder, to be attached to whichever
+// token is emitted next.
+func (l *lexer) addFodder(kind FodderKind, begin Location, text string) {
+	l.pendingFodder = append(l.pendingFodder, FodderElement{
+		Kind: kind,
+		Text: text,
+		Loc:  l.locRange(begin),
+	})
+}
+
+// lexWhitespace consumes a maximal run of spaces, tabs and line breaks. A
+// run containing a fully blank line is fodder in its own right (distinct
+// from ordinary interstitial whitespace) because formatters want to
+// preserve paragraph breaks between comments without preserving every run
+// of spaces verbatim.
+func (l *lexer) lexWhitespace() {
+	begin := l.loc()
+	var sb strings.Builder
+	blankLines := 0
+	atLineStart := false
+	for !l.eof() {
+		c := l.peek()
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			break
+		}
+		// A "\r\n" pair is one line break, not two (see next()): count the
+		// break on the '\n' and let the preceding '\r' pass through unseen.
+		if c == '\r' && l.peekAt(1) == '\n' {
+			sb.WriteRune(l.next())
+			continue
+		}
+		if c == '\n' || c == '\r' {
+			if !atLineStart {
+				atLineStart = true
+			} else {
+				blankLines++
+			}
+		} else {
+			atLineStart = false
+		}
+		sb.WriteRune(l.next())
+	}
+	kind := FodderWhitespace
+	if blankLines > 0 {
+		kind = FodderBlankLine
+	}
+	l.addFodder(kind, begin, sb.String())
+}
+
+// lexToken consumes exactly one non-fodder token starting at c.
+func (l *lexer) lexToken(begin Location, c rune) error {
+	switch c {
+	case '{':
+		l.next()
+		if n := len(l.interpStack); n > 0 {
+			l.interpStack[n-1].braceDepth++
+		}
+		l.emit(tokenBraceL, begin, "{")
+	case '}':
+		if n := len(l.interpStack); n > 0 && l.interpStack[n-1].braceDepth == 0 {
+			frame := l.interpStack[n-1]
+			l.interpStack = l.interpStack[:n-1]
+			l.next()
+			return l.scanStringSegment(l.loc(), frame.quote, tokenStringInterpEnd, tokenStringInterpMid)
+		}
+		l.next()
+		if n := len(l.interpStack); n > 0 {
+			l.interpStack[n-1].braceDepth--
+		}
+		l.emit(tokenBraceR, begin, "}")
+	case '[':
+		l.next()
+		l.emit(tokenBracketL, begin, "[")
+	case ']':
+		l.next()
+		l.emit(tokenBracketR, begin, "]")
+	case ',':
+		l.next()
+		l.emit(tokenComma, begin, ",")
+	case '$':
+		l.next()
+		l.emit(tokenDollar, begin, "$")
+	case '.':
+		l.next()
+		l.emit(tokenDot, begin, ".")
+	case '(':
+		l.next()
+		l.emit(tokenParenL, begin, "(")
+	case ')':
+		l.next()
+		l.emit(tokenParenR, begin, ")")
+	case ';':
+		l.next()
+		l.emit(tokenSemicolon, begin, ";")
+
+	case '"':
+		return l.lexQuotedString(begin, '"', tokenStringDouble)
+	case '\'':
+		return l.lexQuotedString(begin, '\'', tokenStringSingle)
+
+	case '@':
+		return l.lexVerbatimString(begin)
+
+	default:
+		switch {
+		case c == '|' && l.peekAt(1) == '|' && l.peekAt(2) == '|':
+			return l.lexBlockString(begin)
+
+		case isDigit(c):
+			return l.lexNumber(begin)
+
+		case isIdentifierStart(c):
+			l.lexIdentifier(begin)
+
+		case isSymbol(c):
+			l.lexOperator(begin)
+
+		default:
+			l.next()
+			return locError(l.locRange(begin), "Could not lex the character '\\U%08x'", c)
+		}
+	}
+	return nil
+}
+
+func (l *lexer) lexLineComment(kind FodderKind) {
+	begin := l.loc()
+	var sb strings.Builder
+	for !l.eof() && l.peek() != '\n' {
+		sb.WriteRune(l.next())
+	}
+	l.addFodder(kind, begin, sb.String())
+}
+
+func (l *lexer) lexBlockComment() error {
+	begin := l.loc()
+	var sb strings.Builder
+	sb.WriteRune(l.next()) // '/'
+	sb.WriteRune(l.next()) // '*'
+	for {
+		if l.eof() {
+			return locError(l.locRange(begin), "Multi-line comment has no terminating */")
+		}
+		if l.peek() == '*' && l.peekAt(1) == '/' {
+			sb.WriteRune(l.next())
+			sb.WriteRune(l.next())
+			l.addFodder(FodderBlockComment, begin, sb.String())
+			return nil
+		}
+		sb.WriteRune(l.next())
+	}
+}
+
+// lexOperator consumes a maximal run of symbol characters. A '+' or '-' does
+// not extend a run that already has other characters in it, unless it
+// directly follows '>' (so ">-" lexes as one operator, but "<-" lexes as the
+// two operators "<" and "-" — this avoids swallowing a leading unary +/-).
+func (l *lexer) lexOperator(begin Location) {
+	var sb strings.Builder
+	for !l.eof() && isSymbol(l.peek()) {
+		c := l.peek()
+		if (c == '+' || c == '-') && sb.Len() > 0 {
+			last := []rune(sb.String())[sb.Len()-1]
+			if last != '>' {
+				break
+			}
+		}
+		sb.WriteRune(c)
+		l.next()
+	}
+	l.emit(tokenOperator, begin, sb.String())
+}
+
+func (l *lexer) lexIdentifier(begin Location) {
+	var sb strings.Builder
+	for !l.eof() && isIdentifierCont(l.peek()) {
+		sb.WriteRune(l.next())
+	}
+	data := sb.String()
+	if kind, ok := keywords[data]; ok {
+		l.emit(kind, begin, data)
+		return
+	}
+	l.emit(tokenIdentifier, begin, data)
+}
+
+func (l *lexer) lexNumber(begin Location) error {
+	var sb strings.Builder
+
+	first := l.next()
+	sb.WriteRune(first)
+	if first != '0' {
+		for !l.eof() && isDigit(l.peek()) {
+			sb.WriteRune(l.next())
+		}
+	}
+
+	if !l.eof() && l.peek() == '.' {
+		sb.WriteRune(l.next())
+		if l.eof() || !isDigit(l.peek()) {
+			c := l.peekOrEOFRune()
+			return locError(l.locRange(l.loc()), "Couldn't lex number, junk after decimal point: '%c'", c)
+		}
+		for !l.eof() && isDigit(l.peek()) {
+			sb.WriteRune(l.next())
+		}
+	}
+
+	if !l.eof() && (l.peek() == 'e' || l.peek() == 'E') {
+		sb.WriteRune(l.next())
+		if !l.eof() && (l.peek() == '+' || l.peek() == '-') {
+			sb.WriteRune(l.next())
+			if l.eof() || !isDigit(l.peek()) {
+				c := l.peekOrEOFRune()
+				return locError(l.locRange(l.loc()), "Couldn't lex number, junk after exponent sign: '%c'", c)
+			}
+		} else if l.eof() || !isDigit(l.peek()) {
+			c := l.peekOrEOFRune()
+			return locError(l.locRange(l.loc()), "Couldn't lex number, junk after 'E': '%c'", c)
+		}
+		for !l.eof() && isDigit(l.peek()) {
+			sb.WriteRune(l.next())
+		}
+	}
+
+	l.emit(tokenNumber, begin, sb.String())
+	return nil
+}
+
+// peekOrEOFRune is used only for error messages: it returns the offending
+// rune, or the NUL rune if we are already at EOF.
+func (l *lexer) peekOrEOFRune() rune {
+	if l.eof() {
+		return 0
+	}
+	return l.peek()
+}
+
+func (l *lexer) lexQuotedString(begin Location, quote rune, kind tokenKind) error {
+	l.next() // opening quote
+	return l.scanStringSegment(begin, quote, kind, tokenStringInterpStart)
+}
+
+// scanStringSegment scans literal string text starting right after the
+// opening quote (or after a "}" that closed an interpolated expression),
+// stopping at whichever comes first:
+//
+//   - the closing quote, in which case onEnd is emitted with the segment's
+//     text as data and the string is complete;
+//   - an unescaped "${", in which case onInterp is emitted instead, an
+//     interpFrame recording `quote` is pushed so the matching "}" can find
+//     its way back here, and lexing continues with the interpolated
+//     expression.
+func (l *lexer) scanStringSegment(begin Location, quote rune, onEnd, onInterp tokenKind) error {
+	var sb strings.Builder
+	for {
+		if l.eof() {
+			return locError(l.locRange(begin), "Unterminated String")
+		}
+		if l.peek() == '$' && l.peekAt(1) == '{' {
+			interpBegin := l.loc()
+			// The "${" sigil, like the "}" that closes an interpolated
+			// expression, isn't attributed to either of the tokens it
+			// separates: the segment's Range ends here, before it, so the
+			// expression's first token doesn't appear to start inside it.
+			l.emitToken(token{kind: onInterp, data: sb.String(), Range: LocationRange{FileName: l.fileName, Begin: begin, End: interpBegin}})
+			l.next() // '$'
+			l.next() // '{'
+			l.interpStack = append(l.interpStack, interpFrame{quote: quote, begin: interpBegin})
+			return nil
+		}
+		c := l.next()
+		if c == '\\' {
+			sb.WriteRune(c)
+			if l.eof() {
+				return locError(l.locRange(begin), "Unterminated String")
+			}
+			sb.WriteRune(l.next())
+			continue
+		}
+		if c == quote {
+			l.emit(onEnd, begin, sb.String())
+			return nil
+		}
+		sb.WriteRune(c)
+	}
+}
+
+func (l *lexer) lexVerbatimString(begin Location) error {
+	l.next() // '@'
+	if l.eof() {
+		return locError(l.locRange(begin), "Unterminated String")
+	}
+	quote := l.peek()
+	var kind tokenKind
+	switch quote {
+	case '"':
+		kind = tokenVerbatimStringDouble
+	case '\'':
+		kind = tokenVerbatimStringSingle
+	default:
+		return locError(l.locRange(begin), "Couldn't lex verbatim string, junk after '@': %d", quote)
+	}
+	l.next() // opening quote
+
+	var sb strings.Builder
+	for {
+		if l.eof() {
+			return locError(l.locRange(begin), "Unterminated String")
+		}
+		c := l.next()
+		if c == quote {
+			if !l.eof() && l.peek() == quote {
+				l.next()
+				sb.WriteRune(quote)
+				continue
+			}
+			l.emit(kind, begin, sb.String())
+			return nil
+		}
+		sb.WriteRune(c)
+	}
+}
+
+// readBlockStringLine reads up to (and consuming) the next '\n', or to EOF.
+// hitEOF reports whether the line ended because of EOF rather than '\n'.
+// consumedAny reports whether any rune at all was read for this line.
+func (l *lexer) readBlockStringLine() (line string, hitEOF bool, consumedAny bool) {
+	var sb strings.Builder
+	for {
+		if l.eof() {
+			return sb.String(), true, sb.Len() > 0
+		}
+		c := l.peek()
+		if c == '\n' {
+			l.next()
+			return sb.String(), false, true
+		}
+		sb.WriteRune(l.next())
+		consumedAny = true
+	}
+}
+
+func leadingWhitespace(s string) string {
+	i := 0
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return s[:i]
+}
+
+func (l *lexer) lexBlockString(begin Location) error {
+	l.next() // '|'
+	l.next() // '|'
+	l.next() // '|'
+	if l.eof() {
+		return locError(l.locRange(begin), "Unexpected EOF")
+	}
+	if l.peek() != '\n' {
+		return locError(l.locRange(begin), "Text block not terminated with |||")
+	}
+	l.next() // '\n'
+
+	var rawLines []string
+	var indent string
+	haveIndent := false
+
+	for {
+		line, hitEOF, consumedAny := l.readBlockStringLine()
+
+		if line == "" && hitEOF && !consumedAny {
+			return locError(l.locRange(begin), "Text block not terminated with |||")
+		}
+
+		if !haveIndent {
+			if line == "" {
+				rawLines = append(rawLines, line)
+				if hitEOF {
+					return locError(l.locRange(begin), "Unexpected EOF")
+				}
+				continue
+			}
+			ws := leadingWhitespace(line)
+			if ws == "" {
+				return locError(l.locRange(begin), "Text block's first line must start with whitespace")
+			}
+			indent = ws
+			haveIndent = true
+			rawLines = append(rawLines, line)
+			if hitEOF {
+				return locError(l.locRange(begin), "Unexpected EOF")
+			}
+			continue
+		}
+
+		if line != "" {
+			ws := leadingWhitespace(line)
+			if len(ws) < len(indent) {
+				rest := line[len(ws):]
+				if rest == "|||" {
+					data := blockStringData(rawLines, indent)
+					l.emitToken(token{
+						kind:                  tokenStringBlock,
+						data:                  data,
+						stringBlockIndent:     indent,
+						stringBlockTermIndent: ws,
+						Range:                 l.locRange(begin),
+					})
+					return nil
+				}
+				return locError(l.locRange(begin), "Text block not terminated with |||")
+			}
+		}
+
+		rawLines = append(rawLines, line)
+		if hitEOF {
+			return locError(l.locRange(begin), "Unexpected EOF")
+		}
+	}
+}
+
+func blockStringData(rawLines []string, indent string) string {
+	var sb strings.Builder
+	for _, line := range rawLines {
+		if line != "" {
+			sb.WriteString(line[len(indent):])
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
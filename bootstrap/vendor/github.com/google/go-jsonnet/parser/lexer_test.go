@@ -16,7 +16,9 @@ limitations under the License.
 package parser
 
 import (
+	"runtime"
 	"testing"
+	"time"
 )
 
 type lexTest struct {
@@ -113,10 +115,10 @@ var lexTests = []lexTest{
 	{"identifier", "foobar123", Tokens{{kind: tokenIdentifier, data: "foobar123"}}, ""},
 	{"identifier", "foo bar123", Tokens{{kind: tokenIdentifier, data: "foo"}, {kind: tokenIdentifier, data: "bar123"}}, ""},
 
-	{"c++ comment", "// hi", Tokens{}, ""},                                                                     // This test doesn't look at fodder (yet?)
-	{"hash comment", "# hi", Tokens{}, ""},                                                                     // This test doesn't look at fodder (yet?)
-	{"c comment", "/* hi */", Tokens{}, ""},                                                                    // This test doesn't look at fodder (yet?)
-	{"c comment no term", "/* hi", Tokens{}, "c comment no term:1:1 Multi-line comment has no terminating */"}, // This test doesn't look at fodder (yet?)
+	{"c++ comment", "// hi", Tokens{}, ""},                                                                     // Fodder contents are covered separately by TestLexFodder.
+	{"hash comment", "# hi", Tokens{}, ""},                                                                     // Fodder contents are covered separately by TestLexFodder.
+	{"c comment", "/* hi */", Tokens{}, ""},                                                                    // Fodder contents are covered separately by TestLexFodder.
+	{"c comment no term", "/* hi", Tokens{}, "c comment no term:1:1 Multi-line comment has no terminating */"}, // Fodder contents are covered separately by TestLexFodder.
 
 	{
 		"block string spaces",
@@ -236,6 +238,39 @@ test
 	{"verbatim_string_unterminated", `@"blah blah`, Tokens{}, "verbatim_string_unterminated:1:1 Unterminated String"},
 	{"verbatim_string_junk", `@blah blah`, Tokens{}, "verbatim_string_junk:1:1 Couldn't lex verbatim string, junk after '@': 98"},
 
+	{"string interp simple", "\"a${x}b\"", Tokens{
+		{kind: tokenStringInterpStart, data: "a"},
+		{kind: tokenIdentifier, data: "x"},
+		{kind: tokenStringInterpEnd, data: "b"},
+	}, ""},
+	{"string interp repeated", "\"a${x}b${y}c\"", Tokens{
+		{kind: tokenStringInterpStart, data: "a"},
+		{kind: tokenIdentifier, data: "x"},
+		{kind: tokenStringInterpMid, data: "b"},
+		{kind: tokenIdentifier, data: "y"},
+		{kind: tokenStringInterpEnd, data: "c"},
+	}, ""},
+	{"string interp object in expr", "\"a${ {x:1}.x }b\"", Tokens{
+		{kind: tokenStringInterpStart, data: "a"},
+		{kind: tokenBraceL, data: "{"},
+		{kind: tokenIdentifier, data: "x"},
+		{kind: tokenOperator, data: ":"},
+		{kind: tokenNumber, data: "1"},
+		{kind: tokenBraceR, data: "}"},
+		{kind: tokenDot, data: "."},
+		{kind: tokenIdentifier, data: "x"},
+		{kind: tokenStringInterpEnd, data: "b"},
+	}, ""},
+	{"string interp nested string", "\"a${ \"b${c}d\" }e\"", Tokens{
+		{kind: tokenStringInterpStart, data: "a"},
+		{kind: tokenStringInterpStart, data: "b"},
+		{kind: tokenIdentifier, data: "c"},
+		{kind: tokenStringInterpEnd, data: "d"},
+		{kind: tokenStringInterpEnd, data: "e"},
+	}, ""},
+	{"string interp unterminated", "\"a${ 1", Tokens{}, "string interp unterminated:1:3 Unterminated string interpolation"},
+	{"string interp verbatim stays literal", `@"${c}"`, Tokens{{kind: tokenVerbatimStringDouble, data: "${c}"}}, ""},
+
 	{"op *", "*", Tokens{{kind: tokenOperator, data: "*"}}, ""},
 	{"op /", "/", Tokens{{kind: tokenOperator, data: "/"}}, ""},
 	{"op %", "%", Tokens{{kind: tokenOperator, data: "%"}}, ""},
@@ -292,4 +327,269 @@ func TestLex(t *testing.T) {
 	}
 }
 
-// TODO: test fodder, test position reporting
+func TestLexStream(t *testing.T) {
+	for _, test := range lexTests {
+		testTokens := append(Tokens(nil), test.tokens...)
+		testTokens = append(testTokens, tEOF)
+
+		tokenCh, errCh, cancel := LexStream(test.name, test.input)
+		defer cancel()
+		var got Tokens
+		for tok := range tokenCh {
+			got = append(got, tok)
+		}
+		var err error
+		select {
+		case err = <-errCh:
+		default:
+		}
+
+		var errString string
+		if err != nil {
+			errString = err.Error()
+		}
+		if errString != test.errString {
+			t.Errorf("%s: error result does not match. got\n\t%+v\nexpected\n\t%+v",
+				test.name, errString, test.errString)
+		}
+		if err == nil && !tokensEqual(got, testTokens) {
+			t.Errorf("%s: got\n\t%+v\nexpected\n\t%+v", test.name, got, testTokens)
+		}
+	}
+}
+
+// TestLexStreamClosesOnError checks that the token channel is closed, and
+// exactly one error is delivered, when lexing fails partway through.
+func TestLexStreamClosesOnError(t *testing.T) {
+	tokenCh, errCh, cancel := LexStream("partial", `"unterminated`)
+	defer cancel()
+
+	var count int
+	for range tokenCh {
+		count++
+	}
+	if count != 0 {
+		t.Errorf("expected no tokens before the lex error, got %d", count)
+	}
+
+	err := <-errCh
+	if err == nil {
+		t.Fatalf("expected a lex error, got nil")
+	}
+	want := "partial:1:1 Unterminated String"
+	if err.Error() != want {
+		t.Errorf("got error %q, want %q", err.Error(), want)
+	}
+}
+
+// TestLexStreamNoGoroutineLeak checks that the lexing goroutine exits
+// promptly once the consumer cancels, rather than blocking forever trying
+// to send the remaining tokens.
+func TestLexStreamNoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// Large enough that the lexing goroutine will still be producing
+	// tokens long after we stop reading.
+	input := ""
+	for i := 0; i < 10000; i++ {
+		input += "x "
+	}
+	tokenCh, _, cancel := LexStream("big", input)
+	<-tokenCh // read exactly one token
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("lexing goroutine appears to have leaked: NumGoroutine before=%d after=%d", before, runtime.NumGoroutine())
+}
+
+type fodderTest struct {
+	name string
+
+	input string
+
+	// tokenIndex is the index, within the Tokens returned by Lex, of the
+	// token that the given fodder should be attached to.
+	tokenIndex int
+	fodder     []FodderElement
+}
+
+var fodderTests = []fodderTest{
+	{
+		"line comment then identifier", "// hi\nfoo", 0,
+		[]FodderElement{
+			{Kind: FodderLineComment, Text: "// hi"},
+			{Kind: FodderWhitespace, Text: "\n"},
+		},
+	},
+	{
+		"two block comments", "/* a */ /* b */ 1", 0,
+		[]FodderElement{
+			{Kind: FodderBlockComment, Text: "/* a */"},
+			{Kind: FodderWhitespace, Text: " "},
+			{Kind: FodderBlockComment, Text: "/* b */"},
+			{Kind: FodderWhitespace, Text: " "},
+		},
+	},
+	{
+		"hash comment", "# hi\nfoo", 0,
+		[]FodderElement{
+			{Kind: FodderHashComment, Text: "# hi"},
+			{Kind: FodderWhitespace, Text: "\n"},
+		},
+	},
+	{
+		"blank line separates two line comments", "// a\n\n// b\nfoo", 0,
+		[]FodderElement{
+			{Kind: FodderLineComment, Text: "// a"},
+			{Kind: FodderBlankLine, Text: "\n\n"},
+			{Kind: FodderLineComment, Text: "// b"},
+			{Kind: FodderWhitespace, Text: "\n"},
+		},
+	},
+	{
+		// Fodder with nothing left to attach to goes on the EOF token.
+		"trailing comment attaches to EOF", "1 // trailing", 1,
+		[]FodderElement{
+			{Kind: FodderWhitespace, Text: " "},
+			{Kind: FodderLineComment, Text: "// trailing"},
+		},
+	},
+	{
+		// A CRLF is one line break, not two, so this isn't a blank line.
+		"crlf between identifiers is not a blank line", "x\r\ny", 1,
+		[]FodderElement{
+			{Kind: FodderWhitespace, Text: "\r\n"},
+		},
+	},
+	{
+		"two crlfs between identifiers is a blank line", "x\r\n\r\ny", 1,
+		[]FodderElement{
+			{Kind: FodderBlankLine, Text: "\r\n\r\n"},
+		},
+	},
+}
+
+func fodderEqual(f1, f2 []FodderElement) bool {
+	if len(f1) != len(f2) {
+		return false
+	}
+	for i := range f1 {
+		if f1[i].Kind != f2[i].Kind || f1[i].Text != f2[i].Text {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLexFodder(t *testing.T) {
+	for _, test := range fodderTests {
+		tokens, err := Lex(test.name, test.input)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if test.tokenIndex >= len(tokens) {
+			t.Errorf("%s: token index %d out of range (got %d tokens)", test.name, test.tokenIndex, len(tokens))
+			continue
+		}
+		got := tokens[test.tokenIndex].Fodder
+		if !fodderEqual(got, test.fodder) {
+			t.Errorf("%s: got fodder\n\t%+v\nexpected\n\t%+v", test.name, got, test.fodder)
+		}
+	}
+}
+
+// TestLexInterpolationPositions checks that locations keep advancing
+// sensibly across an interpolation boundary, rather than resetting or
+// staying put once the lexer resumes string-scanning after a "}".
+func TestLexInterpolationPositions(t *testing.T) {
+	tokens, err := Lex("interp positions", `"ab${x}cd"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// tokens: StringInterpStart("ab") Identifier("x") StringInterpEnd("cd") EOF
+	if len(tokens) != 4 {
+		t.Fatalf("got %d tokens, want 4: %+v", len(tokens), tokens)
+	}
+	start, ident, end := tokens[0], tokens[1], tokens[2]
+	if start.Range.Begin.Column != 1 {
+		t.Errorf("start segment should begin at column 1, got %d", start.Range.Begin.Column)
+	}
+	if ident.Range.Begin.Column <= start.Range.End.Column {
+		t.Errorf("identifier (col %d) should start after the interpolated segment ends (col %d)",
+			ident.Range.Begin.Column, start.Range.End.Column)
+	}
+	if end.Range.Begin.Column <= ident.Range.End.Column {
+		t.Errorf("trailing segment (col %d) should start after the identifier ends (col %d)",
+			end.Range.Begin.Column, ident.Range.End.Column)
+	}
+}
+
+type positionTest struct {
+	name  string
+	input string
+
+	// positions[i] is the expected Range.Begin of the i'th token Lex
+	// returns, including the trailing EOF token.
+	positions []Location
+}
+
+var positionTests = []positionTest{
+	{
+		"identifiers across a line break", "a\nb",
+		[]Location{
+			{Line: 1, Column: 1, Offset: 0},
+			{Line: 2, Column: 1, Offset: 2},
+			{Line: 2, Column: 2, Offset: 3},
+		},
+	},
+	{
+		"block string with embedded newlines", "|||\n  hi\n  there\n|||\nx",
+		[]Location{
+			{Line: 1, Column: 1, Offset: 0},
+			{Line: 5, Column: 1, Offset: 21},
+			{Line: 5, Column: 2, Offset: 22},
+		},
+	},
+	{
+		`"\r\n" counts as a single line break`, "a\r\nb",
+		[]Location{
+			{Line: 1, Column: 1, Offset: 0},
+			{Line: 2, Column: 1, Offset: 3},
+			{Line: 2, Column: 2, Offset: 4},
+		},
+	},
+}
+
+// TestLexPositions checks Range.Begin for every token of a handful of
+// inputs chosen to exercise position bookkeeping across a plain line
+// break, a multi-line block string, and a "\r\n" pair (which must count as
+// one line break, not two, per TestLexPositions's third case). Error
+// positions -- including that an unterminated string's error points at its
+// opening quote rather than wherever EOF was hit -- are already exercised
+// by errString in lexTests, e.g. the "double string \"hi" case asserting
+// "1:1".
+func TestLexPositions(t *testing.T) {
+	for _, test := range positionTests {
+		tokens, err := Lex(test.name, test.input)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if len(tokens) != len(test.positions) {
+			t.Errorf("%s: got %d tokens, want %d: %+v", test.name, len(tokens), len(test.positions), tokens)
+			continue
+		}
+		for i, want := range test.positions {
+			if got := tokens[i].Range.Begin; got != want {
+				t.Errorf("%s: token %d begins at %+v, want %+v", test.name, i, got, want)
+			}
+		}
+	}
+}